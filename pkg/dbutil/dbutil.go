@@ -0,0 +1,379 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dbutil holds small helpers shared by the diff/sync tools for
+// talking to a database: connection config, schema introspection and a
+// handful of SQL string builders.
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+)
+
+// DBConfig is the configuration needed to open a connection to MySQL/TiDB.
+type DBConfig struct {
+	Host     string `toml:"host" json:"host"`
+	Port     int    `toml:"port" json:"port"`
+	User     string `toml:"user" json:"user"`
+	Password string `toml:"password" json:"password"`
+	Schema   string `toml:"schema" json:"schema"`
+}
+
+// OpenDB opens a *sql.DB using the given config.
+func OpenDB(cfg DBConfig) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Schema)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return db, nil
+}
+
+// GetDBConfigFromEnv builds a DBConfig for the given schema from the
+// MYSQL_HOST/MYSQL_PORT/MYSQL_USER/MYSQL_PSWD environment variables, which
+// is how the integration tests point the suite at a running instance.
+func GetDBConfigFromEnv(schema string) DBConfig {
+	host := os.Getenv("MYSQL_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port, _ := strconv.Atoi(os.Getenv("MYSQL_PORT"))
+	if port == 0 {
+		port = 3306
+	}
+	user := os.Getenv("MYSQL_USER")
+	if user == "" {
+		user = "root"
+	}
+
+	return DBConfig{
+		Host:     host,
+		Port:     port,
+		User:     user,
+		Password: os.Getenv("MYSQL_PSWD"),
+		Schema:   schema,
+	}
+}
+
+// GetTableInfoBySQL parses a `CREATE TABLE` statement and returns the
+// resulting *model.TableInfo. It's mainly used by unit tests that want a
+// TableInfo without going through a live connection.
+func GetTableInfoBySQL(createTableSQL string) (*model.TableInfo, error) {
+	p := parser.New()
+	stmt, err := p.ParseOneStmt(createTableSQL, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s, ok := stmt.(*ast.CreateTableStmt)
+	if !ok {
+		return nil, errors.Errorf("expect CREATE TABLE statement, got %T", stmt)
+	}
+
+	return buildTableInfo(s)
+}
+
+// SelectUniqueOrderKey returns the name of the column set that can be used
+// to uniquely and deterministically order rows of tableInfo: the primary
+// key if there is one, otherwise the first unique key, otherwise all
+// columns.
+func SelectUniqueOrderKey(tableInfo *model.TableInfo) (orderKeyName string, orderKeyCols []*model.ColumnInfo) {
+	if tableInfo.PKIsHandle {
+		for _, col := range tableInfo.Columns {
+			if mysqlHasPriKeyFlag(col) {
+				return col.Name.O, []*model.ColumnInfo{col}
+			}
+		}
+	}
+
+	// Try the primary key before any unique key, whatever their order in
+	// tableInfo.Indices.
+	indices := make([]*model.IndexInfo, 0, len(tableInfo.Indices))
+	for _, index := range tableInfo.Indices {
+		if index.Primary {
+			indices = append([]*model.IndexInfo{index}, indices...)
+		} else {
+			indices = append(indices, index)
+		}
+	}
+	for _, index := range indices {
+		if index.Primary || index.Unique {
+			cols := make([]*model.ColumnInfo, 0, len(index.Columns))
+			names := make([]string, 0, len(index.Columns))
+			for _, indexCol := range index.Columns {
+				col := findColumnByName(tableInfo.Columns, indexCol.Name.O)
+				if col == nil {
+					continue
+				}
+				cols = append(cols, col)
+				names = append(names, col.Name.O)
+			}
+			if len(cols) > 0 {
+				return strings.Join(names, ","), cols
+			}
+		}
+	}
+
+	names := make([]string, 0, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		names = append(names, col.Name.O)
+	}
+	return strings.Join(names, ","), tableInfo.Columns
+}
+
+// GetRandomValues returns `num` random values of `column` in `schema`.`table`
+// that fall within [min, max] and satisfy limitRange, used to pick split
+// points when sampling a table. limitRange is a self-contained boolean SQL
+// expression (e.g. "true", or rangeCondition's output) with no placeholders
+// of its own - there's no variadic limitArgs to fill one, since mismatching
+// that count against limitRange's actual placeholders is exactly what broke
+// this query against a live MySQL before. randomSample is the caller's
+// dialect.RandomSample(num) (MySQL's ORDER BY RAND() isn't valid SQL on
+// Postgres, so this package - which has no notion of dialects - can't
+// render it itself). Each value is scanned into its string form (the same
+// thing buildInitialChunks does for a chunk bound) rather than
+// interface{}, so callers get back a column value they can drop straight
+// into a WHERE clause instead of a driver-specific []byte.
+func GetRandomValues(ctx context.Context, db *sql.DB, schema, table, column string, num int, min, max interface{}, limitRange, randomSample string) ([]interface{}, error) {
+	if limitRange == "" {
+		limitRange = "true"
+	}
+
+	query := fmt.Sprintf(
+		"SELECT `%s` FROM `%s`.`%s` WHERE `%s` BETWEEN ? AND ? AND %s %s",
+		column, schema, table, column, limitRange, randomSample,
+	)
+	args := []interface{}{min, max}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	values := make([]interface{}, 0, num)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		values = append(values, v)
+	}
+
+	return values, errors.Trace(rows.Err())
+}
+
+func findColumnByName(cols []*model.ColumnInfo, name string) *model.ColumnInfo {
+	for _, col := range cols {
+		if col.Name.O == name {
+			return col
+		}
+	}
+	return nil
+}
+
+func mysqlHasPriKeyFlag(col *model.ColumnInfo) bool {
+	const priKeyFlag = 1 << 1
+	return col.Flag&priKeyFlag != 0
+}
+
+// buildTableInfo assembles a *model.TableInfo from a parsed CREATE TABLE
+// statement: column definitions (types, null/default/generated-ness) plus
+// the primary and unique keys needed by SelectUniqueOrderKey. It only
+// builds the subset of TableInfo this package's SQL generation actually
+// reads; it doesn't aim to be a full DDL implementation (auto_increment
+// bookkeeping, foreign keys, partitioning, ... are left at their zero
+// value).
+func buildTableInfo(stmt *ast.CreateTableStmt) (*model.TableInfo, error) {
+	info := &model.TableInfo{
+		Name:    model.NewCIStr(stmt.Table.Name.O),
+		Charset: mysql.DefaultCharset,
+		Collate: mysql.DefaultCollationName,
+	}
+	for _, opt := range stmt.Options {
+		switch opt.Tp {
+		case ast.TableOptionCharset:
+			info.Charset = opt.StrValue
+		case ast.TableOptionCollate:
+			info.Collate = opt.StrValue
+		case ast.TableOptionComment:
+			info.Comment = opt.StrValue
+		}
+	}
+
+	colByName := make(map[string]*model.ColumnInfo, len(stmt.Cols))
+	var inlineKeys []*ast.Constraint
+	for i, col := range stmt.Cols {
+		colInfo, err := buildColumnInfo(col, i)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		info.Columns = append(info.Columns, colInfo)
+		colByName[colInfo.Name.L] = colInfo
+
+		for _, opt := range col.Options {
+			switch opt.Tp {
+			case ast.ColumnOptionPrimaryKey:
+				inlineKeys = append(inlineKeys, inlineKeyConstraint(ast.ConstraintPrimaryKey, col.Name))
+			case ast.ColumnOptionUniqKey:
+				inlineKeys = append(inlineKeys, inlineKeyConstraint(ast.ConstraintUniq, col.Name))
+			}
+		}
+	}
+
+	for _, constraint := range append(inlineKeys, stmt.Constraints...) {
+		index, err := buildIndexInfo(info.Name.O, colByName, constraint)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if index == nil {
+			continue
+		}
+		if index.Primary {
+			for _, idxCol := range index.Columns {
+				colByName[idxCol.Name.L].Flag |= mysql.PriKeyFlag | mysql.NotNullFlag
+			}
+			info.PKIsHandle = len(index.Columns) == 1 && isIntegerColumn(colByName[index.Columns[0].Name.L])
+		}
+		info.Indices = append(info.Indices, index)
+	}
+
+	return info, nil
+}
+
+// buildColumnInfo builds one model.ColumnInfo from its parsed definition,
+// recording the flags (NOT NULL, PRIMARY KEY, UNIQUE, AUTO_INCREMENT) and
+// the generated-column expression (if any) that SelectUniqueOrderKey and
+// generateDML rely on.
+func buildColumnInfo(col *ast.ColumnDef, offset int) (*model.ColumnInfo, error) {
+	if col.Tp == nil {
+		return nil, errors.Errorf("column %s has no type", col.Name.Name.O)
+	}
+
+	colInfo := &model.ColumnInfo{
+		Name:      model.NewCIStr(col.Name.Name.O),
+		Offset:    offset,
+		FieldType: *col.Tp,
+	}
+
+	hasDefaultValue := false
+	for _, opt := range col.Options {
+		switch opt.Tp {
+		case ast.ColumnOptionNotNull, ast.ColumnOptionPrimaryKey:
+			colInfo.Flag |= mysql.NotNullFlag
+			if opt.Tp == ast.ColumnOptionPrimaryKey {
+				colInfo.Flag |= mysql.PriKeyFlag
+			}
+		case ast.ColumnOptionUniqKey:
+			colInfo.Flag |= mysql.UniqueKeyFlag
+		case ast.ColumnOptionAutoIncrement:
+			colInfo.Flag |= mysql.AutoIncrementFlag
+		case ast.ColumnOptionDefaultValue:
+			if v, ok := opt.Expr.(ast.ValueExpr); ok {
+				colInfo.DefaultValue = v.GetValue()
+				colInfo.OriginDefaultValue = colInfo.DefaultValue
+				hasDefaultValue = true
+			}
+		case ast.ColumnOptionGenerated:
+			// opt.Expr.Text() isn't populated for a column-option
+			// sub-expression in this parser version - only the top-level
+			// statement gets its source text recorded - so the expression
+			// has to be reconstructed via Restore instead.
+			var buf strings.Builder
+			if err := opt.Expr.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &buf)); err != nil {
+				return nil, errors.Trace(err)
+			}
+			colInfo.GeneratedExprString = buf.String()
+			colInfo.GeneratedStored = opt.Stored
+		}
+	}
+
+	// NoDefaultValueFlag marks a column with no DEFAULT clause at all, so
+	// an explicit DEFAULT NULL stays distinguishable from it.
+	if !hasDefaultValue && len(colInfo.GeneratedExprString) == 0 {
+		colInfo.Flag |= mysql.NoDefaultValueFlag
+	}
+
+	return colInfo, nil
+}
+
+// buildIndexInfo turns a table- or column-level key/constraint into a
+// model.IndexInfo. Constraint kinds that don't produce a lookup index
+// (foreign keys, CHECK, FULLTEXT) return a nil index, which the caller
+// skips.
+func buildIndexInfo(tableName string, colByName map[string]*model.ColumnInfo, constraint *ast.Constraint) (*model.IndexInfo, error) {
+	switch constraint.Tp {
+	case ast.ConstraintPrimaryKey, ast.ConstraintKey, ast.ConstraintIndex,
+		ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+	default:
+		return nil, nil
+	}
+
+	cols := make([]*model.IndexColumn, 0, len(constraint.Keys))
+	for _, key := range constraint.Keys {
+		col, ok := colByName[key.Column.Name.L]
+		if !ok {
+			return nil, errors.Errorf("index references unknown column %s", key.Column.Name.O)
+		}
+		cols = append(cols, &model.IndexColumn{Name: col.Name, Offset: col.Offset, Length: key.Length})
+	}
+
+	primary := constraint.Tp == ast.ConstraintPrimaryKey
+	unique := primary || constraint.Tp == ast.ConstraintUniq ||
+		constraint.Tp == ast.ConstraintUniqKey || constraint.Tp == ast.ConstraintUniqIndex
+
+	name := constraint.Name
+	if name == "" {
+		if primary {
+			name = "PRIMARY"
+		} else {
+			name = cols[0].Name.O
+		}
+	}
+
+	return &model.IndexInfo{
+		Name:    model.NewCIStr(name),
+		Table:   model.NewCIStr(tableName),
+		Columns: cols,
+		Unique:  unique,
+		Primary: primary,
+	}, nil
+}
+
+// inlineKeyConstraint wraps a single column named inline as `... PRIMARY
+// KEY`/`... UNIQUE KEY` in the same *ast.Constraint shape as a table-level
+// key, so buildIndexInfo can handle both uniformly.
+func inlineKeyConstraint(tp ast.ConstraintType, col *ast.ColumnName) *ast.Constraint {
+	return &ast.Constraint{Tp: tp, Keys: []*ast.IndexColName{{Column: col}}}
+}
+
+func isIntegerColumn(col *model.ColumnInfo) bool {
+	switch col.FieldType.Tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		return true
+	default:
+		return false
+	}
+}
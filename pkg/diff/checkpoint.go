@@ -0,0 +1,223 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+)
+
+// ChunkStatus records how far a chunk of the checksum tree got the last
+// time it was checked.
+type ChunkStatus string
+
+const (
+	// ChunkPending has not been checked yet, or was interrupted mid-check.
+	ChunkPending ChunkStatus = "pending"
+	// ChunkEqual means the chunk's hash matched on both sides; a resumed
+	// run can skip it entirely.
+	ChunkEqual ChunkStatus = "equal"
+	// ChunkFixed means the chunk differed and its fix SQL has been emitted
+	// up to FixSeq.
+	ChunkFixed ChunkStatus = "fixed"
+)
+
+// ChunkState is the persisted checkpoint for one chunk of one table
+// comparison.
+type ChunkState struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+
+	LowerBound []string `json:"lower_bound"`
+	UpperBound []string `json:"upper_bound"`
+
+	Hash   uint64      `json:"hash"`
+	Status ChunkStatus `json:"status"`
+
+	// FixSeq is the sequence number of the last fix SQL emitted for this
+	// chunk, so a crashed run knows which of its REPLACE/DELETE statements
+	// definitely made it out and which need to be regenerated.
+	FixSeq int64 `json:"fix_seq"`
+}
+
+func (s *ChunkState) key() string {
+	return chunkKey(s.Schema, s.Table, chunkRange{LowerBound: s.LowerBound, UpperBound: s.UpperBound})
+}
+
+func chunkKey(schema, table string, r chunkRange) string {
+	return strings.Join([]string{schema, table, strings.Join(r.LowerBound, ","), strings.Join(r.UpperBound, ",")}, "|")
+}
+
+// Checkpointer persists the status of each chunk in a table comparison so
+// that a re-run after a crash or SIGTERM can skip ranges already known to
+// be equal and pick up fix-SQL emission where it left off.
+type Checkpointer interface {
+	// Load returns every chunk state previously saved for schema.table.
+	Load(ctx context.Context, schema, table string) (map[string]*ChunkState, error)
+	// Save persists (or overwrites) the state of a single chunk.
+	Save(ctx context.Context, state *ChunkState) error
+}
+
+// FileCheckpointer stores chunk states as a single JSON file on disk. It's
+// the default for single-process runs of sync-diff-inspector.
+type FileCheckpointer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileCheckpointer creates a FileCheckpointer backed by the file at path.
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{Path: path}
+}
+
+// Load implements Checkpointer.
+func (f *FileCheckpointer) Load(ctx context.Context, schema, table string) (map[string]*ChunkState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return map[string]*ChunkState{}, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var all map[string]*ChunkState
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := make(map[string]*ChunkState)
+	for k, state := range all {
+		if state.Schema == schema && state.Table == table {
+			result[k] = state
+		}
+	}
+	return result, nil
+}
+
+// Save implements Checkpointer. It rewrites the whole checkpoint file, which
+// is simple and crash-safe (via a temp-file-plus-rename) at the cost of
+// O(n) writes; checkpoint files are expected to be small enough that this
+// doesn't matter.
+func (f *FileCheckpointer) Save(ctx context.Context, state *ChunkState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	all := map[string]*ChunkState{}
+	if data, err := ioutil.ReadFile(f.Path); err == nil {
+		if err := json.Unmarshal(data, &all); err != nil {
+			return errors.Trace(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+
+	all[state.key()] = state
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tmp := f.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, f.Path))
+}
+
+// MySQLCheckpointer stores chunk states in a MySQL/TiDB table, which is
+// useful when several sync-diff-inspector processes share checkpoint state
+// or when the host running the diff isn't expected to keep local disk.
+type MySQLCheckpointer struct {
+	Conn  *sql.DB
+	Table string // fully qualified, e.g. `diff`.`checkpoints`
+}
+
+// NewMySQLCheckpointer creates a MySQLCheckpointer and ensures its backing
+// table exists.
+func NewMySQLCheckpointer(ctx context.Context, conn *sql.DB, table string) (*MySQLCheckpointer, error) {
+	c := &MySQLCheckpointer{Conn: conn, Table: table}
+	createSQL := `CREATE TABLE IF NOT EXISTS ` + table + ` (
+		chunk_key VARCHAR(1024) NOT NULL PRIMARY KEY,
+		schema_name VARCHAR(255) NOT NULL,
+		table_name VARCHAR(255) NOT NULL,
+		lower_bound TEXT,
+		upper_bound TEXT,
+		hash BIGINT UNSIGNED NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		fix_seq BIGINT NOT NULL DEFAULT 0
+	)`
+	if _, err := conn.ExecContext(ctx, createSQL); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// Load implements Checkpointer.
+func (m *MySQLCheckpointer) Load(ctx context.Context, schema, table string) (map[string]*ChunkState, error) {
+	query := `SELECT chunk_key, schema_name, table_name, lower_bound, upper_bound, hash, status, fix_seq
+		FROM ` + m.Table + ` WHERE schema_name = ? AND table_name = ?`
+	rows, err := m.Conn.QueryContext(ctx, query, schema, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]*ChunkState)
+	for rows.Next() {
+		var (
+			key, lowerBound, upperBound string
+			state                       ChunkState
+		)
+		if err := rows.Scan(&key, &state.Schema, &state.Table, &lowerBound, &upperBound, &state.Hash, &state.Status, &state.FixSeq); err != nil {
+			return nil, errors.Trace(err)
+		}
+		state.LowerBound = splitBound(lowerBound)
+		state.UpperBound = splitBound(upperBound)
+		result[key] = &state
+	}
+	return result, errors.Trace(rows.Err())
+}
+
+// Save implements Checkpointer.
+func (m *MySQLCheckpointer) Save(ctx context.Context, state *ChunkState) error {
+	query := `INSERT INTO ` + m.Table + `
+		(chunk_key, schema_name, table_name, lower_bound, upper_bound, hash, status, fix_seq)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE hash = VALUES(hash), status = VALUES(status), fix_seq = VALUES(fix_seq)`
+	_, err := m.Conn.ExecContext(ctx, query,
+		state.key(), state.Schema, state.Table,
+		strings.Join(state.LowerBound, ","), strings.Join(state.UpperBound, ","),
+		state.Hash, state.Status, state.FixSeq,
+	)
+	return errors.Trace(err)
+}
+
+func splitBound(s string) []string {
+	if s == "" {
+		return []string{""}
+	}
+	return strings.Split(s, ",")
+}
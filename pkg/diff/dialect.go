@@ -0,0 +1,155 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+)
+
+// Dialect hides the small set of SQL differences between the database
+// engines TableDiff can compare, so the comparison logic itself - chunking,
+// hashing, bisection - stays engine-agnostic.
+type Dialect interface {
+	// QuoteIdent quotes a single identifier (column, table, or schema name).
+	QuoteIdent(ident string) string
+	// LimitOffset renders a LIMIT/OFFSET clause.
+	LimitOffset(limit, offset int64) string
+	// RandomSample renders an ORDER BY .. LIMIT clause that returns n rows
+	// in random order, used to pick bisection midpoints.
+	RandomSample(n int) string
+	// IntrospectSchema returns the table definition of schema.table.
+	IntrospectSchema(ctx context.Context, conn *sql.DB, schema, table string) (*model.TableInfo, error)
+	// NullWrap renders an expression that substitutes the literal string
+	// 'NULL' for ident when it's NULL, so two rows that differ only in
+	// which columns are NULL still concatenate to visibly different
+	// strings in ConcatExpr.
+	NullWrap(ident string) string
+	// ConcatExpr renders the SELECT-list expression that concatenates
+	// `columns` (already passed through NullWrap) into one per-row string,
+	// which chunkChecksum hashes client-side. Hashing happens in Go rather
+	// than via a dialect-specific SQL aggregate so that a chunk's
+	// fingerprint only depends on the row data, not on which engine
+	// produced the concatenated string - a MySQL CRC32/Postgres md5
+	// aggregate could never agree on the same data.
+	ConcatExpr(columns []string) string
+	// UpsertStatement renders the fix-SQL equivalent of "insert or replace
+	// this row", e.g. REPLACE INTO on MySQL or INSERT .. ON CONFLICT on
+	// Postgres.
+	UpsertStatement(schema, table string, orderKeyCols []*model.ColumnInfo, columnNames, values []string) string
+}
+
+// mysqlDialect is the behavior TableDiff had before dialects existed, and
+// remains the default when TableInstance.Dialect is left unset.
+type mysqlDialect struct{}
+
+func (mysqlDialect) QuoteIdent(ident string) string {
+	return fmt.Sprintf("`%s`", ident)
+}
+
+func (mysqlDialect) LimitOffset(limit, offset int64) string {
+	return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+func (mysqlDialect) RandomSample(n int) string {
+	return fmt.Sprintf("ORDER BY RAND() LIMIT %d", n)
+}
+
+func (mysqlDialect) IntrospectSchema(ctx context.Context, conn *sql.DB, schema, table string) (*model.TableInfo, error) {
+	row := conn.QueryRowContext(ctx, fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`", schema, table))
+	var name, createSQL string
+	if err := row.Scan(&name, &createSQL); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return dbutil.GetTableInfoBySQL(createSQL)
+}
+
+func (mysqlDialect) NullWrap(ident string) string {
+	return fmt.Sprintf("IFNULL(%s, 'NULL')", ident)
+}
+
+func (mysqlDialect) ConcatExpr(columns []string) string {
+	return fmt.Sprintf("CONCAT_WS('#', %s)", strings.Join(columns, ", "))
+}
+
+func (d mysqlDialect) UpsertStatement(schema, table string, orderKeyCols []*model.ColumnInfo, columnNames, values []string) string {
+	return fmt.Sprintf(
+		"REPLACE INTO %s.%s(%s) VALUES (%s);",
+		d.QuoteIdent(schema), d.QuoteIdent(table), strings.Join(columnNames, ","), strings.Join(values, ","),
+	)
+}
+
+// postgresDialect renders PostgreSQL syntax: double-quoted identifiers,
+// RANDOM() sampling, COALESCE/concat_ws row strings and INSERT .. ON
+// CONFLICT upserts. Its IntrospectSchema is not implemented and always
+// returns an error, so Equal stops at the structure check for a
+// TableInstance that uses this dialect.
+type postgresDialect struct{}
+
+func (postgresDialect) QuoteIdent(ident string) string {
+	return fmt.Sprintf("%q", ident)
+}
+
+func (postgresDialect) LimitOffset(limit, offset int64) string {
+	return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+func (postgresDialect) RandomSample(n int) string {
+	return fmt.Sprintf("ORDER BY RANDOM() LIMIT %d", n)
+}
+
+func (postgresDialect) IntrospectSchema(ctx context.Context, conn *sql.DB, schema, table string) (*model.TableInfo, error) {
+	// No query is made: conn is not used, and every call fails.
+	return nil, errors.Errorf("postgresDialect.IntrospectSchema: not implemented, cannot introspect %s.%s", schema, table)
+}
+
+func (postgresDialect) NullWrap(ident string) string {
+	return fmt.Sprintf("COALESCE(%s, 'NULL')", ident)
+}
+
+func (postgresDialect) ConcatExpr(columns []string) string {
+	return fmt.Sprintf("concat_ws('#', %s)", strings.Join(columns, ", "))
+}
+
+func (d postgresDialect) UpsertStatement(schema, table string, orderKeyCols []*model.ColumnInfo, columnNames, values []string) string {
+	conflictCols := make([]string, 0, len(orderKeyCols))
+	for _, col := range orderKeyCols {
+		conflictCols = append(conflictCols, d.QuoteIdent(col.Name.O))
+	}
+
+	updates := make([]string, 0, len(columnNames))
+	for _, col := range columnNames {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+	}
+
+	return fmt.Sprintf(
+		"INSERT INTO %s.%s(%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s;",
+		d.QuoteIdent(schema), d.QuoteIdent(table), strings.Join(columnNames, ","), strings.Join(values, ","),
+		strings.Join(conflictCols, ","), strings.Join(updates, ","),
+	)
+}
+
+// dialectOf returns table.Dialect, defaulting to mysqlDialect.
+func dialectOf(table *TableInstance) Dialect {
+	if table.Dialect != nil {
+		return table.Dialect
+	}
+	return mysqlDialect{}
+}
@@ -0,0 +1,874 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diff compares the schema and data of a source table (possibly
+// sharded across several TableInstances) against a target table, and
+// produces a stream of fix-up DML that would make the target match the
+// source.
+package diff
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+)
+
+const (
+	// defaultChunkSize is used when TableDiff.ChunkSize is left unset.
+	defaultChunkSize = 1000
+
+	// defaultMinChunkSize is the point at which a mismatched chunk is no
+	// longer bisected and is instead compared and fixed row by row.
+	defaultMinChunkSize = 100
+
+	// defaultCheckThreadCount bounds how many chunks are hashed/compared
+	// concurrently when no explicit concurrency is configured.
+	defaultCheckThreadCount = 4
+)
+
+// HashFunc names the Go hash function used to fingerprint one row's
+// dialect-rendered, concatenated column values. chunkChecksum XOR-combines
+// the per-row hashes into a single chunk-level fingerprint, the same way
+// BIT_XOR(...) aggregated a SQL-side hash before hashing moved client-side
+// so it would stay comparable across dialects (see dialect.go's ConcatExpr
+// doc comment).
+type HashFunc string
+
+const (
+	// HashCRC32 hashes each row with crc32.ChecksumIEEE.
+	HashCRC32 HashFunc = "crc32"
+	// HashXXHash hashes each row with xxHash32, cheaper to compute over
+	// very large chunks than the extra collision margin HashCRC32 gives.
+	HashXXHash HashFunc = "xxhash"
+)
+
+// TableInstance is one physical table (source shard or target) that takes
+// part in a comparison.
+type TableInstance struct {
+	Conn   *sql.DB
+	Schema string
+	Table  string
+
+	// Dialect selects the SQL dialect used to talk to this instance.
+	// Defaults to a MySQL/TiDB dialect when left nil, so existing callers
+	// are unaffected.
+	Dialect Dialect
+}
+
+// chunkRange is the inclusive/exclusive key range [LowerBound, UpperBound)
+// of a chunk of rows. Each bound holds one formatted value, that of the
+// first column `SelectUniqueOrderKey` returns (an empty string means
+// unbounded), so a node can be re-hydrated into a WHERE clause without
+// knowing anything else about the table; the other order key columns play
+// no part in a chunk's range.
+type chunkRange struct {
+	LowerBound []string
+	UpperBound []string
+}
+
+// chunkNode is one node of the checksum tree built over a table: the hash
+// and row count of everything between LowerBound and UpperBound, plus the
+// children it was bisected into once a mismatch forced us to look closer.
+type chunkNode struct {
+	chunkRange
+	Hash     uint64
+	RowCount int64
+	// Checked is true once this node's hash has been compared against its
+	// counterpart on the other side; Equal records the result.
+	Checked  bool
+	Equal    bool
+	Children []*chunkNode
+}
+
+// TableDiff represents a comparison task between one or more source tables
+// (e.g. the shards of a sharded table) and a single target table.
+type TableDiff struct {
+	SourceTables []*TableInstance
+	TargetTable  *TableInstance
+
+	// IgnoreColumns are excluded from both the hash computation and the
+	// row-by-row comparison, typically volatile columns like `updated_at`
+	// that are expected to differ. The generated fix DML still carries them.
+	IgnoreColumns []string
+
+	// ChunkSize is the number of rows an initial (leaf) chunk of the
+	// checksum tree covers. Defaults to defaultChunkSize.
+	ChunkSize int
+
+	// MinChunkRows is the row count at or below which a mismatched chunk is
+	// no longer bisected, and is instead compared and fixed row by row.
+	// Defaults to defaultMinChunkSize.
+	MinChunkRows int
+
+	// CheckThreadCount bounds how many chunks are hashed or compared
+	// concurrently. Defaults to defaultCheckThreadCount.
+	CheckThreadCount int
+
+	// HashFunc selects the Go hash function rowHash applies to each row
+	// when fingerprinting a chunk. Defaults to HashCRC32.
+	HashFunc HashFunc
+
+	// AllowDestructive permits checkTableStruct to emit DROP COLUMN and
+	// DROP INDEX statements. When false (the default), a structural
+	// difference that would require one of those is left unfixed and the
+	// tables are reported as unequal.
+	AllowDestructive bool
+
+	// Checkpointer, if set, is consulted before scanning each chunk and
+	// updated after finishing it, so a re-run after a crash or SIGTERM can
+	// skip ranges already known to be equal and resume fix-SQL emission.
+	Checkpointer Checkpointer
+
+	// FixSink, if set, receives every fix-up row change as a structured
+	// FixEvent alongside the SQL passed to writeFixSQL, so operators can pipe
+	// diff-derived corrections through the same downstream consumers they
+	// already run for changefeeds. A resolved-ts marker is pushed once a
+	// chunk has been fully checked (and fixed, if needed), the same
+	// checkpoint boundary a changefeed consumer would expect.
+	FixSink FixEventSink
+
+	sourceTableInfo *model.TableInfo
+	targetTableInfo *model.TableInfo
+	orderKeyCols    []*model.ColumnInfo
+
+	// sinkTs stands in for a real commit timestamp, which this tool has no
+	// access to outside of a live changefeed: it's a logical counter, unique
+	// and increasing across one Equal call, good enough to order and
+	// checkpoint FixSink events.
+	sinkTs int64
+
+	// root is the in-memory checksum tree built by the most recent Equal
+	// call. Later calls rebuild it instead of reading it; skipping ranges
+	// that already proved equal goes through Checkpointer.
+	root *chunkNode
+}
+
+func (t *TableDiff) chunkSize() int {
+	if t.ChunkSize > 0 {
+		return t.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+func (t *TableDiff) minChunkRows() int {
+	if t.MinChunkRows > 0 {
+		return t.MinChunkRows
+	}
+	return defaultMinChunkSize
+}
+
+func (t *TableDiff) checkThreadCount() int {
+	if t.CheckThreadCount > 0 {
+		return t.CheckThreadCount
+	}
+	return defaultCheckThreadCount
+}
+
+func (t *TableDiff) hashFunc() HashFunc {
+	if t.HashFunc != "" {
+		return t.HashFunc
+	}
+	return HashCRC32
+}
+
+// Equal checks whether the target table has the same structure and data as
+// the source table(s), calling writeFixSQL with any DML needed to bring the
+// target in line. Chunks of data are hashed and compared concurrently (up
+// to CheckThreadCount at a time), but writeFixSQL itself is always invoked
+// serially: the caller's callback doesn't need to be goroutine-safe. It
+// returns whether the structures and the data, respectively, were found to
+// be equal.
+func (t *TableDiff) Equal(ctx context.Context, writeFixSQL func(sql string) error) (structEqual bool, dataEqual bool, err error) {
+	structEqual, err = t.checkTableStruct(ctx, writeFixSQL)
+	if err != nil {
+		return false, false, errors.Trace(err)
+	}
+	if !structEqual {
+		return false, false, nil
+	}
+
+	dataEqual, err = t.checkTableData(ctx, writeFixSQL)
+	if err != nil {
+		return structEqual, false, errors.Trace(err)
+	}
+
+	return structEqual, dataEqual, nil
+}
+
+// checkTableStruct compares the source and target table definitions -
+// columns, indices, and table-level charset/collation - and writes out the
+// ALTER TABLE statements (via writeFixSQL) that would bring target in line
+// with source. DROP COLUMN and DROP INDEX are only emitted when
+// AllowDestructive is set; if such a change is needed but not allowed, the
+// tables are still reported as unequal so the caller isn't misled.
+func (t *TableDiff) checkTableStruct(ctx context.Context, writeFixSQL func(sql string) error) (bool, error) {
+	source := t.SourceTables[0]
+	target := t.TargetTable
+
+	sourceInfo, err := getTableInfo(ctx, source)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	targetInfo, err := getTableInfo(ctx, target)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	t.sourceTableInfo = sourceInfo
+	t.targetTableInfo = targetInfo
+
+	alters, equal := diffTableStruct(sourceInfo, targetInfo, t.AllowDestructive)
+	for _, alter := range alters {
+		if err := writeFixSQL(alter); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+
+	return equal, nil
+}
+
+// checkTableData walks the checksum tree of the source table, descending
+// into any chunk whose hash disagrees with the target's until it can either
+// confirm equality or has bisected down to MinChunkRows, at which point the
+// mismatched rows are compared and fixed one by one.
+func (t *TableDiff) checkTableData(ctx context.Context, writeFixSQL func(sql string) error) (bool, error) {
+	source := t.SourceTables[0]
+	target := t.TargetTable
+
+	_, orderKeyCols := dbutil.SelectUniqueOrderKey(t.sourceTableInfo)
+	t.orderKeyCols = orderKeyCols
+
+	chunks, err := t.buildInitialChunks(ctx, source)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	t.root = &chunkNode{Children: chunks}
+
+	var prior map[string]*ChunkState
+	if t.Checkpointer != nil {
+		prior, err = t.Checkpointer.Load(ctx, source.Schema, source.Table)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+
+	// sem bounds how many chunks are actually being hashed or compared
+	// against the database at once. It's created once here and threaded
+	// through every recursive compareChunk call instead of each node
+	// making its own, so CheckThreadCount is a real cap on total concurrent
+	// work rather than one that multiplies with recursion depth. It's
+	// acquired only around the query/compare itself, never held across a
+	// node's wg.Wait() for its children, so a full semaphore can't deadlock
+	// against children waiting for a slot.
+	sem := make(chan struct{}, t.checkThreadCount())
+
+	// serialWrite serializes calls into writeFixSQL: compareChunk runs many
+	// chunks concurrently, so without this a caller's writeFixSQL closure
+	// (e.g. one that appends to a slice, as the test harness does) would be
+	// invoked from multiple goroutines at once.
+	var writeMu sync.Mutex
+	serialWrite := func(sql string) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFixSQL(sql)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		equal    = true
+	)
+	for _, chunk := range chunks {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(chunk *chunkNode) {
+			defer wg.Done()
+
+			chunkEqual, err := t.compareChunk(ctx, source, target, chunk, prior, sem, serialWrite)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if !chunkEqual {
+				equal = false
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	return equal, errors.Trace(firstErr)
+}
+
+// buildInitialChunks splits the source table into ordered chunks of roughly
+// ChunkSize rows each, bounded by the value of the first order-key column at
+// every ChunkSize-th offset. Each chunk becomes the root of its own checksum
+// subtree, descended into only if its hash disagrees with the target.
+func (t *TableDiff) buildInitialChunks(ctx context.Context, source *TableInstance) ([]*chunkNode, error) {
+	dialect := dialectOf(source)
+
+	var rowCount int64
+	row := source.Conn.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(1) FROM %s.%s", dialect.QuoteIdent(source.Schema), dialect.QuoteIdent(source.Table)))
+	if err := row.Scan(&rowCount); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rowCount == 0 {
+		return []*chunkNode{{}}, nil
+	}
+
+	chunkSize := int64(t.chunkSize())
+	numChunks := (rowCount + chunkSize - 1) / chunkSize
+	col := dialect.QuoteIdent(t.orderKeyCols[0].Name.O)
+
+	bounds := make([]string, 0, numChunks-1)
+	for i := int64(1); i < numChunks; i++ {
+		query := fmt.Sprintf(
+			"SELECT %s FROM %s.%s ORDER BY %s %s",
+			col, dialect.QuoteIdent(source.Schema), dialect.QuoteIdent(source.Table), col, dialect.LimitOffset(1, i*chunkSize),
+		)
+		var bound string
+		if err := source.Conn.QueryRowContext(ctx, query).Scan(&bound); err != nil {
+			return nil, errors.Trace(err)
+		}
+		bounds = append(bounds, bound)
+	}
+
+	chunks := make([]*chunkNode, 0, numChunks)
+	lower := ""
+	for _, upper := range bounds {
+		chunks = append(chunks, &chunkNode{chunkRange: chunkRange{LowerBound: []string{lower}, UpperBound: []string{upper}}})
+		lower = upper
+	}
+	chunks = append(chunks, &chunkNode{chunkRange: chunkRange{LowerBound: []string{lower}, UpperBound: []string{""}}})
+
+	return chunks, nil
+}
+
+// compareChunk hashes `node`'s range on both sides. If the hashes agree the
+// chunk is marked equal and recursion stops; otherwise, if the chunk still
+// has more rows than MinChunkRows it is bisected into two children which
+// are compared independently. At or below that threshold, or when bisect
+// finds no key to split on, it falls back to fetching and diffing the
+// actual rows. sem bounds actual query/compare
+// work across the whole tree; see checkTableData's comment on it. Children
+// are always spawned as goroutines regardless of sem's availability - only
+// the work a goroutine does once it actually runs waits on sem - so a node
+// blocked in wg.Wait() for its children never holds a slot a child needs.
+func (t *TableDiff) compareChunk(ctx context.Context, source, target *TableInstance, node *chunkNode, prior map[string]*ChunkState, sem chan struct{}, writeFixSQL func(sql string) error) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.Trace(err)
+	}
+
+	key := chunkKey(source.Schema, source.Table, node.chunkRange)
+	if state, ok := prior[key]; ok && state.Status == ChunkEqual {
+		node.Equal = true
+		node.Checked = true
+		return true, nil
+	}
+
+	sem <- struct{}{}
+	sourceHash, sourceCount, err := t.chunkChecksum(ctx, source, node.chunkRange)
+	if err != nil {
+		<-sem
+		return false, errors.Trace(err)
+	}
+	targetHash, _, err := t.chunkChecksum(ctx, target, node.chunkRange)
+	<-sem
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	node.Hash = sourceHash
+	node.RowCount = sourceCount
+	node.Checked = true
+
+	if sourceHash == targetHash {
+		node.Equal = true
+		t.saveCheckpoint(ctx, source, node, ChunkEqual, 0)
+		t.markResolved(ctx)
+		return true, nil
+	}
+
+	// A bisect that hands back node's own range as one half found nothing
+	// to split on; such a chunk is compared row by row like a small one.
+	var left, right chunkRange
+	split := false
+	if sourceCount > int64(t.minChunkRows()) {
+		sem <- struct{}{}
+		left, right, err = t.bisect(ctx, source, node.chunkRange)
+		<-sem
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		split = chunkKey(source.Schema, source.Table, left) != key && chunkKey(source.Schema, source.Table, right) != key
+	}
+
+	if !split {
+		skipSeq := int64(0)
+		if state, ok := prior[key]; ok {
+			skipSeq = state.FixSeq
+		}
+		sem <- struct{}{}
+		equal, seq, err := t.compareRows(ctx, source, target, node.chunkRange, skipSeq, writeFixSQL)
+		<-sem
+		node.Equal = equal
+		status := ChunkFixed
+		if equal {
+			status = ChunkEqual
+		}
+		t.saveCheckpoint(ctx, source, node, status, seq)
+		t.markResolved(ctx)
+		return equal, errors.Trace(err)
+	}
+
+	node.Children = []*chunkNode{{chunkRange: left}, {chunkRange: right}}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		equal    = true
+	)
+	for _, child := range node.Children {
+		wg.Add(1)
+		go func(child *chunkNode) {
+			defer wg.Done()
+
+			childEqual, err := t.compareChunk(ctx, source, target, child, prior, sem, writeFixSQL)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if !childEqual {
+				equal = false
+			}
+		}(child)
+	}
+	wg.Wait()
+
+	return equal, errors.Trace(firstErr)
+}
+
+// bisect splits a chunk's key range into two halves around one key value
+// sampled at random from the range, so the halves are not guaranteed to
+// hold similar numbers of rows.
+func (t *TableDiff) bisect(ctx context.Context, source *TableInstance, r chunkRange) (left, right chunkRange, err error) {
+	dialect := dialectOf(source)
+	mid, err := dbutil.GetRandomValues(
+		ctx, source.Conn, source.Schema, source.Table,
+		t.orderKeyCols[0].Name.O, 1,
+		boundValue(r.LowerBound), boundValue(r.UpperBound),
+		rangeCondition(dialect, t.orderKeyCols, r), dialect.RandomSample(1),
+	)
+	if err != nil {
+		return chunkRange{}, chunkRange{}, errors.Trace(err)
+	}
+	if len(mid) == 0 {
+		// Nothing left to split on; hand back r itself as the left half so
+		// compareChunk sees no split and falls back to row comparison.
+		return r, chunkRange{LowerBound: r.UpperBound, UpperBound: r.UpperBound}, nil
+	}
+
+	// GetRandomValues scans its result into string, the same as
+	// buildInitialChunks does for a chunk bound; mid[0] is already the
+	// value's string form and isn't something to further %v-format (that
+	// would print a driver-returned []byte as e.g. "[49 50 51]").
+	midStr := mid[0].(string)
+	left = chunkRange{LowerBound: r.LowerBound, UpperBound: []string{midStr}}
+	right = chunkRange{LowerBound: []string{midStr}, UpperBound: r.UpperBound}
+	return left, right, nil
+}
+
+// chunkChecksum returns the aggregated row hash and row count of `r` on
+// `table`, using the configured HashFunc. The per-row hash is computed in
+// Go from the dialect's ConcatExpr rather than by a SQL-side aggregate
+// (CRC32/md5, BIT_XOR/SUM, ...), which differs enough between engines that
+// two dialect-specific aggregates could never agree on the same data -
+// defeating the whole point of comparing a MySQL source against a
+// Postgres target.
+func (t *TableDiff) chunkChecksum(ctx context.Context, table *TableInstance, r chunkRange) (hash uint64, rowCount int64, err error) {
+	dialect := dialectOf(table)
+	columns := hashableColumns(dialect, t.sourceTableInfo, t.IgnoreColumns)
+	expr := dialect.ConcatExpr(columns)
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s.%s WHERE %s",
+		expr, dialect.QuoteIdent(table.Schema), dialect.QuoteIdent(table.Table), rangeCondition(dialect, t.orderKeyCols, r),
+	)
+
+	rows, err := table.Conn.QueryContext(ctx, query)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		hash ^= rowHash(value, t.hashFunc())
+		rowCount++
+	}
+
+	return hash, rowCount, errors.Trace(rows.Err())
+}
+
+// rowHash fingerprints one row's concatenated column value with the
+// configured HashFunc; chunkChecksum XOR-combines these across a chunk,
+// order-independently, the same way BIT_XOR(...) did when hashing happened
+// in SQL.
+func rowHash(value string, hashFunc HashFunc) uint64 {
+	if hashFunc == HashXXHash {
+		return uint64(xxhash32([]byte(value)))
+	}
+	return uint64(crc32.ChecksumIEEE([]byte(value)))
+}
+
+// compareRows fetches the actual rows of a small (<= MinChunkRows) range
+// from both sides and emits REPLACE/DELETE statements for whatever doesn't
+// match, the same row-by-row strategy used before chunking existed. Fix
+// SQLs are numbered from 1 in ascending key order (sourceRows/targetRows
+// are maps, so iterating them directly would number rows in Go's
+// randomized map order and make skipSeq/FixSeq meaningless across runs);
+// skipSeq suppresses re-emitting ones a prior, interrupted run already
+// flushed, while still advancing the sequence so the checkpoint stays
+// consistent. It returns the sequence number of the last fix SQL written
+// (or skipped as already written); a fix whose write failed is not
+// counted. The caller checkpoints it as ChunkState.FixSeq.
+func (t *TableDiff) compareRows(ctx context.Context, source, target *TableInstance, r chunkRange, skipSeq int64, writeFixSQL func(sql string) error) (bool, int64, error) {
+	sourceRows, err := fetchRows(ctx, source, t.sourceTableInfo, t.orderKeyCols, r)
+	if err != nil {
+		return false, 0, errors.Trace(err)
+	}
+	targetRows, err := fetchRows(ctx, target, t.sourceTableInfo, t.orderKeyCols, r)
+	if err != nil {
+		return false, 0, errors.Trace(err)
+	}
+
+	var seq int64
+	emit := func(op FixOp, row rowData, sql string) error {
+		seq++
+		if seq <= skipSeq {
+			return nil
+		}
+		if err := t.emitFix(ctx, target.Schema, target.Table, op, row, sql, writeFixSQL); err != nil {
+			seq--
+			return err
+		}
+		return nil
+	}
+
+	equal := true
+	for _, key := range sortedKeys(sourceRows) {
+		row := sourceRows[key]
+		targetRow, ok := targetRows[key]
+		if !ok || !rowsEqual(row, targetRow, t.IgnoreColumns) {
+			equal = false
+			sql := generateDML(dialectOf(target), "replace", row.data, row.null, t.orderKeyCols, t.sourceTableInfo, target.Schema)
+			if err := emit(FixOpUpdate, row, sql); err != nil {
+				return false, seq, errors.Trace(err)
+			}
+		}
+		delete(targetRows, key)
+	}
+	for _, key := range sortedKeys(targetRows) {
+		equal = false
+		sql := generateDML(dialectOf(target), "delete", targetRows[key].data, targetRows[key].null, t.orderKeyCols, t.sourceTableInfo, target.Schema)
+		if err := emit(FixOpDelete, targetRows[key], sql); err != nil {
+			return false, seq, errors.Trace(err)
+		}
+	}
+
+	return equal, seq, nil
+}
+
+// sortedKeys returns rows' keys in ascending order, so compareRows numbers
+// fix SQLs deterministically instead of in Go's randomized map order.
+func sortedKeys(rows map[string]rowData) []string {
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// emitFix writes sql via writeFixSQL and, when a FixSink is configured,
+// sends the structured equivalent at the same time rather than one after the
+// other, so a slow publish to Kafka doesn't add to the latency of the SQL
+// path operators already depend on.
+func (t *TableDiff) emitFix(ctx context.Context, schema, table string, op FixOp, row rowData, sql string, writeFixSQL func(sql string) error) error {
+	if t.FixSink == nil {
+		return errors.Trace(writeFixSQL(sql))
+	}
+
+	var wg sync.WaitGroup
+	var sqlErr, sinkErr error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sqlErr = writeFixSQL(sql)
+	}()
+	go func() {
+		defer wg.Done()
+		event := fixEvent(op, schema, table, row, t.orderKeyCols)
+		event.CommitTs = t.nextSinkTs()
+		sinkErr = t.FixSink.Send(ctx, event)
+	}()
+	wg.Wait()
+
+	if sqlErr != nil {
+		return errors.Trace(sqlErr)
+	}
+	return errors.Trace(sinkErr)
+}
+
+// markResolved pushes a resolved-ts watermark to FixSink once a chunk has
+// been fully checked and fixed, so a consumer draining FixEvents can
+// checkpoint between chunks the same way it would between changefeed
+// batches. The failure is swallowed for the same reason saveCheckpoint's is:
+// a missed watermark only costs the consumer a slightly later checkpoint.
+func (t *TableDiff) markResolved(ctx context.Context) {
+	if t.FixSink == nil {
+		return
+	}
+	_ = t.FixSink.ResolvedTs(ctx, t.nextSinkTs())
+}
+
+func (t *TableDiff) nextSinkTs() int64 {
+	return atomic.AddInt64(&t.sinkTs, 1)
+}
+
+// saveCheckpoint persists node's outcome via t.Checkpointer, if configured.
+// Failures are swallowed: a missed checkpoint write only costs a re-check
+// on the next resume, which is preferable to failing an otherwise-successful
+// comparison over it.
+func (t *TableDiff) saveCheckpoint(ctx context.Context, source *TableInstance, node *chunkNode, status ChunkStatus, fixSeq int64) {
+	if t.Checkpointer == nil {
+		return
+	}
+	state := &ChunkState{
+		Schema:     source.Schema,
+		Table:      source.Table,
+		LowerBound: node.LowerBound,
+		UpperBound: node.UpperBound,
+		Hash:       node.Hash,
+		Status:     status,
+		FixSeq:     fixSeq,
+	}
+	_ = t.Checkpointer.Save(ctx, state)
+}
+
+type rowData struct {
+	data map[string][]byte
+	null map[string]bool
+}
+
+func rowsEqual(a, b rowData, ignoreColumns []string) bool {
+	ignore := make(map[string]bool, len(ignoreColumns))
+	for _, c := range ignoreColumns {
+		ignore[c] = true
+	}
+	for col, v := range a.data {
+		if ignore[col] {
+			continue
+		}
+		if a.null[col] != b.null[col] || string(v) != string(b.data[col]) {
+			return false
+		}
+	}
+	return true
+}
+
+func fetchRows(ctx context.Context, table *TableInstance, tableInfo *model.TableInfo, orderKeyCols []*model.ColumnInfo, r chunkRange) (map[string]rowData, error) {
+	dialect := dialectOf(table)
+
+	columnNames := make([]string, 0, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		columnNames = append(columnNames, dialect.QuoteIdent(col.Name.O))
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s.%s WHERE %s",
+		strings.Join(columnNames, ", "), dialect.QuoteIdent(table.Schema), dialect.QuoteIdent(table.Table), rangeCondition(dialect, orderKeyCols, r),
+	)
+
+	rows, err := table.Conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := make(map[string]rowData)
+	for rows.Next() {
+		rawValues := make([][]byte, len(cols))
+		scanArgs := make([]interface{}, len(cols))
+		for i := range rawValues {
+			scanArgs[i] = &rawValues[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		data := make(map[string][]byte, len(cols))
+		null := make(map[string]bool, len(cols))
+		keyParts := make([]string, 0, len(orderKeyCols))
+		for i, col := range cols {
+			data[col] = rawValues[i]
+			null[col] = rawValues[i] == nil
+		}
+		for _, keyCol := range orderKeyCols {
+			keyParts = append(keyParts, string(data[keyCol.Name.O]))
+		}
+
+		result[strings.Join(keyParts, "#")] = rowData{data: data, null: null}
+	}
+
+	return result, errors.Trace(rows.Err())
+}
+
+func getTableInfo(ctx context.Context, table *TableInstance) (*model.TableInfo, error) {
+	return dialectOf(table).IntrospectSchema(ctx, table.Conn, table.Schema, table.Table)
+}
+
+// hashableColumns returns the quoted, null-wrapped column expressions to
+// feed into dialect.ConcatExpr, skipping anything in ignoreColumns. The
+// null wrapper is dialect-specific (IFNULL on MySQL, COALESCE on Postgres),
+// so this can't just hardcode MySQL's syntax the way it used to.
+func hashableColumns(dialect Dialect, tableInfo *model.TableInfo, ignoreColumns []string) []string {
+	ignore := make(map[string]bool, len(ignoreColumns))
+	for _, c := range ignoreColumns {
+		ignore[strings.ToLower(c)] = true
+	}
+
+	columns := make([]string, 0, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		if ignore[col.Name.L] {
+			continue
+		}
+		columns = append(columns, dialect.NullWrap(dialect.QuoteIdent(col.Name.O)))
+	}
+	return columns
+}
+
+// rangeCondition renders a chunkRange as a WHERE clause against orderKeyCols.
+// An empty bound means "unbounded" on that side.
+func rangeCondition(dialect Dialect, orderKeyCols []*model.ColumnInfo, r chunkRange) string {
+	if len(orderKeyCols) == 0 {
+		return "1=1"
+	}
+	col := dialect.QuoteIdent(orderKeyCols[0].Name.O)
+
+	conds := make([]string, 0, 2)
+	if len(r.LowerBound) > 0 && r.LowerBound[0] != "" {
+		conds = append(conds, fmt.Sprintf("%s >= '%s'", col, r.LowerBound[0]))
+	}
+	if len(r.UpperBound) > 0 && r.UpperBound[0] != "" {
+		conds = append(conds, fmt.Sprintf("%s < '%s'", col, r.UpperBound[0]))
+	}
+	if len(conds) == 0 {
+		return "1=1"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func boundValue(bound []string) interface{} {
+	if len(bound) == 0 || bound[0] == "" {
+		return nil
+	}
+	return bound[0]
+}
+
+// generateDML builds a REPLACE/DELETE statement (or the target dialect's
+// equivalent) for one row of tableInfo. tp is either "replace" or "delete".
+func generateDML(dialect Dialect, tp string, rowsData map[string][]byte, null map[string]bool, orderKeyCols []*model.ColumnInfo, tableInfo *model.TableInfo, schema string) string {
+	switch tp {
+	case "replace":
+		columnNames := make([]string, 0, len(tableInfo.Columns))
+		values := make([]string, 0, len(tableInfo.Columns))
+		for _, col := range tableInfo.Columns {
+			// MySQL/TiDB reject explicit values for generated columns
+			// (virtual or stored); they're recomputed from the other
+			// columns, so there's nothing useful to REPLACE them with.
+			if col.IsGenerated() {
+				continue
+			}
+			columnNames = append(columnNames, dialect.QuoteIdent(col.Name.O))
+			values = append(values, columnValue(dialect, rowsData[col.Name.O], null[col.Name.O], col))
+		}
+		return dialect.UpsertStatement(schema, tableInfo.Name.O, orderKeyCols, columnNames, values)
+	case "delete":
+		where := make([]string, 0, len(orderKeyCols))
+		for _, col := range orderKeyCols {
+			// Unlike the REPLACE column list above, a generated column is
+			// never skipped here: every column in orderKeyCols already
+			// participates in the chosen unique key by construction, so
+			// dropping one would under-constrain the WHERE clause and risk
+			// deleting rows outside the intended key.
+			ident := dialect.QuoteIdent(col.Name.O)
+			if null[col.Name.O] {
+				where = append(where, fmt.Sprintf("%s is NULL", ident))
+				continue
+			}
+			where = append(where, fmt.Sprintf("%s = %s", ident, columnValue(dialect, rowsData[col.Name.O], false, col)))
+		}
+		return fmt.Sprintf(
+			"DELETE FROM %s.%s WHERE %s;",
+			dialect.QuoteIdent(schema), dialect.QuoteIdent(tableInfo.Name.O), strings.Join(where, " AND "),
+		)
+	default:
+		panic(fmt.Sprintf("unknown dml type %s", tp))
+	}
+}
+
+func columnValue(dialect Dialect, data []byte, isNull bool, col *model.ColumnInfo) string {
+	if isNull {
+		return "NULL"
+	}
+	if needsQuoting(col) {
+		return fmt.Sprintf("'%s'", strings.Replace(string(data), "'", "''", -1))
+	}
+	return string(data)
+}
+
+func needsQuoting(col *model.ColumnInfo) bool {
+	switch col.FieldType.Tp {
+	case mysql.TypeVarchar, mysql.TypeString, mysql.TypeVarString,
+		mysql.TypeDatetime, mysql.TypeDate, mysql.TypeNewDate, mysql.TypeDuration, mysql.TypeTimestamp,
+		mysql.TypeJSON, mysql.TypeBlob, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob:
+		return true
+	default:
+		return false
+	}
+}
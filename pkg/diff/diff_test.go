@@ -17,7 +17,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"sync"
 	"testing"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -54,8 +57,8 @@ func (*testDiffSuite) TestGenerateSQLs(c *C) {
 		"money":       false,
 	}
 	_, orderKeyCols := dbutil.SelectUniqueOrderKey(tableInfo)
-	replaceSQL := generateDML("replace", rowsData, null, orderKeyCols, tableInfo, "test")
-	deleteSQL := generateDML("delete", rowsData, null, orderKeyCols, tableInfo, "test")
+	replaceSQL := generateDML(mysqlDialect{}, "replace", rowsData, null, orderKeyCols, tableInfo, "test")
+	deleteSQL := generateDML(mysqlDialect{}, "delete", rowsData, null, orderKeyCols, tableInfo, "test")
 	c.Assert(replaceSQL, Equals, "REPLACE INTO `test`.`atest`(`id`,`name`,`birthday`,`update_time`,`money`) VALUES (1,'xxx','2018-01-01 00:00:00','10:10:10',11.1111);")
 	c.Assert(deleteSQL, Equals, "DELETE FROM `test`.`atest` WHERE `id` = 1;")
 
@@ -64,25 +67,151 @@ func (*testDiffSuite) TestGenerateSQLs(c *C) {
 	tableInfo2, err := dbutil.GetTableInfoBySQL(createTableSQL2)
 	c.Assert(err, IsNil)
 	_, orderKeyCols2 := dbutil.SelectUniqueOrderKey(tableInfo2)
-	replaceSQL = generateDML("replace", rowsData, null, orderKeyCols2, tableInfo2, "test")
-	deleteSQL = generateDML("delete", rowsData, null, orderKeyCols2, tableInfo2, "test")
+	replaceSQL = generateDML(mysqlDialect{}, "replace", rowsData, null, orderKeyCols2, tableInfo2, "test")
+	deleteSQL = generateDML(mysqlDialect{}, "delete", rowsData, null, orderKeyCols2, tableInfo2, "test")
 	c.Assert(replaceSQL, Equals, "REPLACE INTO `test`.`atest`(`id`,`name`,`birthday`,`update_time`,`money`) VALUES (1,'xxx','2018-01-01 00:00:00','10:10:10',11.1111);")
 	c.Assert(deleteSQL, Equals, "DELETE FROM `test`.`atest` WHERE `id` = 1 AND `name` = 'xxx';")
 
 	// test value is nil
 	rowsData["name"] = []byte("")
 	null["name"] = true
-	replaceSQL = generateDML("replace", rowsData, null, orderKeyCols, tableInfo, "test")
-	deleteSQL = generateDML("delete", rowsData, null, orderKeyCols, tableInfo, "test")
+	replaceSQL = generateDML(mysqlDialect{}, "replace", rowsData, null, orderKeyCols, tableInfo, "test")
+	deleteSQL = generateDML(mysqlDialect{}, "delete", rowsData, null, orderKeyCols, tableInfo, "test")
 	c.Assert(replaceSQL, Equals, "REPLACE INTO `test`.`atest`(`id`,`name`,`birthday`,`update_time`,`money`) VALUES (1,NULL,'2018-01-01 00:00:00','10:10:10',11.1111);")
 	c.Assert(deleteSQL, Equals, "DELETE FROM `test`.`atest` WHERE `id` = 1;")
 
 	rowsData["id"] = []byte("")
 	null["id"] = true
-	replaceSQL = generateDML("replace", rowsData, null, orderKeyCols, tableInfo, "test")
-	deleteSQL = generateDML("delete", rowsData, null, orderKeyCols, tableInfo, "test")
+	replaceSQL = generateDML(mysqlDialect{}, "replace", rowsData, null, orderKeyCols, tableInfo, "test")
+	deleteSQL = generateDML(mysqlDialect{}, "delete", rowsData, null, orderKeyCols, tableInfo, "test")
 	c.Assert(replaceSQL, Equals, "REPLACE INTO `test`.`atest`(`id`,`name`,`birthday`,`update_time`,`money`) VALUES (NULL,NULL,'2018-01-01 00:00:00','10:10:10',11.1111);")
 	c.Assert(deleteSQL, Equals, "DELETE FROM `test`.`atest` WHERE `id` is NULL;")
+
+	// test generated columns: neither the virtual nor the stored one should
+	// show up in the REPLACE column list/values, since MySQL/TiDB reject
+	// explicit values for them.
+	createTableSQL3 := "CREATE TABLE `test`.`atest` (`a` int(24), `c` int(24) AS (`a`+1) VIRTUAL, `d` int(24) AS (`a`+2) STORED, primary key(`a`))"
+	tableInfo3, err := dbutil.GetTableInfoBySQL(createTableSQL3)
+	c.Assert(err, IsNil)
+	rowsData3 := map[string][]byte{
+		"a": []byte("1"),
+		"c": []byte("2"),
+		"d": []byte("3"),
+	}
+	null3 := map[string]bool{
+		"a": false,
+		"c": false,
+		"d": false,
+	}
+	_, orderKeyCols3 := dbutil.SelectUniqueOrderKey(tableInfo3)
+	replaceSQL = generateDML(mysqlDialect{}, "replace", rowsData3, null3, orderKeyCols3, tableInfo3, "test")
+	deleteSQL = generateDML(mysqlDialect{}, "delete", rowsData3, null3, orderKeyCols3, tableInfo3, "test")
+	c.Assert(replaceSQL, Equals, "REPLACE INTO `test`.`atest`(`a`) VALUES (1);")
+	c.Assert(deleteSQL, Equals, "DELETE FROM `test`.`atest` WHERE `a` = 1;")
+}
+
+// TestPostgresDialect covers the Postgres-specific SQL generation used when
+// a TableInstance's Dialect is set to compare a MySQL source against a
+// Postgres target, e.g. to validate a migration. It doesn't require a live
+// Postgres connection, just like TestGenerateSQLs doesn't require MySQL.
+func (*testDiffSuite) TestPostgresDialect(c *C) {
+	createTableSQL := "CREATE TABLE `test`.`atest` (`id` int(24), `name` varchar(24), primary key(`id`))"
+	tableInfo, err := dbutil.GetTableInfoBySQL(createTableSQL)
+	c.Assert(err, IsNil)
+
+	rowsData := map[string][]byte{
+		"id":   []byte("1"),
+		"name": []byte("xxx"),
+	}
+	null := map[string]bool{
+		"id":   false,
+		"name": false,
+	}
+	_, orderKeyCols := dbutil.SelectUniqueOrderKey(tableInfo)
+
+	dialect := postgresDialect{}
+	replaceSQL := generateDML(dialect, "replace", rowsData, null, orderKeyCols, tableInfo, "test")
+	deleteSQL := generateDML(dialect, "delete", rowsData, null, orderKeyCols, tableInfo, "test")
+	c.Assert(replaceSQL, Equals, `INSERT INTO "test"."atest"("id","name") VALUES (1,'xxx') ON CONFLICT ("id") DO UPDATE SET "id" = EXCLUDED."id","name" = EXCLUDED."name";`)
+	c.Assert(deleteSQL, Equals, `DELETE FROM "test"."atest" WHERE "id" = 1;`)
+
+	c.Assert(dialect.QuoteIdent("atest"), Equals, `"atest"`)
+	c.Assert(dialect.LimitOffset(10, 20), Equals, "LIMIT 10 OFFSET 20")
+}
+
+// TestChunkHashCrossDialect checks rowHash, the client-side hash that
+// chunkChecksum applies to every row whatever the dialect: it takes only
+// the row's concatenated string and the HashFunc, gives the same value for
+// the same string, gives different values under HashCRC32 and HashXXHash
+// for the sample row, and its XOR combination is order independent. No
+// dialect or database is involved.
+func (*testDiffSuite) TestChunkHashCrossDialect(c *C) {
+	value := "1#xxx"
+	c.Assert(rowHash(value, HashCRC32), Equals, rowHash(value, HashCRC32))
+	c.Assert(rowHash(value, HashCRC32), Not(Equals), rowHash(value, HashXXHash))
+
+	// XOR-combining is order independent, the same property BIT_XOR(...)
+	// relied on when the aggregate ran in SQL.
+	a, b := rowHash("1#xxx", HashCRC32), rowHash("2#yyy", HashCRC32)
+	c.Assert(a^b, Equals, b^a)
+}
+
+type fakeKafkaProducer struct {
+	mu       sync.Mutex
+	messages []fakeKafkaMessage
+}
+
+type fakeKafkaMessage struct {
+	partition int32
+	key       []byte
+	value     []byte
+}
+
+func (f *fakeKafkaProducer) SendMessage(topic string, partition int32, key, value []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, fakeKafkaMessage{partition: partition, key: key, value: value})
+	return nil
+}
+
+func (*testDiffSuite) TestKafkaSink(c *C) {
+	tableInfo, err := dbutil.GetTableInfoBySQL("CREATE TABLE `test`.`atest` (`id` int(24), `name` varchar(24), primary key(`id`))")
+	c.Assert(err, IsNil)
+	_, orderKeyCols := dbutil.SelectUniqueOrderKey(tableInfo)
+
+	producer := &fakeKafkaProducer{}
+	sink := &KafkaSink{Producer: producer, Topic: "fix-events", Partitions: 4}
+
+	row := rowData{
+		data: map[string][]byte{"id": []byte("1"), "name": []byte("xxx")},
+		null: map[string]bool{"id": false, "name": false},
+	}
+	event := fixEvent(FixOpUpdate, "test", "atest", row, orderKeyCols)
+	c.Assert(sink.Send(context.Background(), event), IsNil)
+	c.Assert(sink.Send(context.Background(), event), IsNil)
+	c.Assert(sink.ResolvedTs(context.Background(), 1), IsNil)
+
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	c.Assert(producer.messages, HasLen, 2+int(sink.Partitions))
+	// Every event for the same row must land on the same partition, so a
+	// consumer sees them in order - this holds because partitionFor hashes
+	// columns in a fixed order (KeyCols here), never in map iteration order.
+	c.Assert(producer.messages[0].partition, Equals, producer.messages[1].partition)
+	c.Assert(string(producer.messages[0].value), Equals, `{"u":{"id":"1","name":"xxx"}}`)
+
+	// A row with the same key (here, just "id") but a different non-key
+	// column must land on the same partition as the first row, since only
+	// the key columns are hashed.
+	sameKeyRow := rowData{
+		data: map[string][]byte{"id": []byte("1"), "name": []byte("yyy")},
+		null: map[string]bool{"id": false, "name": false},
+	}
+	sameKeyEvent := fixEvent(FixOpUpdate, "test", "atest", sameKeyRow, orderKeyCols)
+	c.Assert(sink.Send(context.Background(), sameKeyEvent), IsNil)
+	// messages[2:6] are the four ResolvedTs partition markers just asserted
+	// above; the sameKeyEvent send is the message after those.
+	c.Assert(producer.messages[6].partition, Equals, producer.messages[0].partition)
 }
 
 func (t *testDiffSuite) TestDiff(c *C) {
@@ -94,6 +223,7 @@ func (t *testDiffSuite) TestDiff(c *C) {
 
 	testStructEqual(dbConn, c)
 	testDataEqual(dbConn, c)
+	testResume(dbConn, c)
 }
 
 func testStructEqual(conn *sql.DB, c *C) {
@@ -202,6 +332,58 @@ func testDataEqual(dbConn *sql.DB, c *C) {
 	c.Assert(dataEqual, Equals, true)
 }
 
+// testResume checks graceful shutdown around a shared Checkpointer: a
+// checkTableData call whose context is already cancelled returns an error,
+// and a later call with a live context and the same Checkpointer still
+// reports the data as equal. The cancelled call stops before any chunk is
+// checked, so nothing is checkpointed and this doesn't check that chunks
+// recorded as equal are skipped.
+func testResume(dbConn *sql.DB, c *C) {
+	sourceTable := "testresumea"
+	targetTable := "testresumeb"
+
+	defer func() {
+		_, _ = dbConn.Query(fmt.Sprintf("drop table test.%s", sourceTable))
+		_, _ = dbConn.Query(fmt.Sprintf("drop table test.%s", targetTable))
+	}()
+
+	err := generateData(dbConn, dbutil.GetDBConfigFromEnv("test"), sourceTable, targetTable)
+	c.Assert(err, IsNil)
+
+	checkpointFile, err := ioutil.TempFile("", "diff-checkpoint-")
+	c.Assert(err, IsNil)
+	checkpointFile.Close()
+	defer os.Remove(checkpointFile.Name())
+
+	tableDiff := &TableDiff{
+		SourceTables: []*TableInstance{{Conn: dbConn, Schema: "test", Table: sourceTable}},
+		TargetTable:  &TableInstance{Conn: dbConn, Schema: "test", Table: targetTable},
+		Checkpointer: NewFileCheckpointer(checkpointFile.Name()),
+	}
+
+	// Run the struct check for real first: it doesn't checkpoint anything
+	// of its own, so cancelling the context around it (as a prior version
+	// of this test did via Equal) only ever exercises a bare context-error
+	// return and never reaches the chunk-resume code path at all.
+	structEqual, err := tableDiff.checkTableStruct(context.Background(), func(sql string) error { return nil })
+	c.Assert(err, IsNil)
+	c.Assert(structEqual, Equals, true)
+
+	// Simulate a process that's asked to shut down gracefully mid-check:
+	// checkTableData should stop promptly and report the context error
+	// rather than hang or panic.
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tableDiff.checkTableData(cancelledCtx, func(sql string) error { return nil })
+	c.Assert(err, NotNil)
+
+	// A fresh run with an un-cancelled context and the same checkpointer
+	// should still converge on "equal".
+	dataEqual, err := tableDiff.checkTableData(context.Background(), func(sql string) error { return nil })
+	c.Assert(err, IsNil)
+	c.Assert(dataEqual, Equals, true)
+}
+
 func createTableDiff(db *sql.DB) *TableDiff {
 	sourceTableInstance := &TableInstance{
 		Conn:   db,
@@ -261,7 +443,7 @@ func generateData(dbConn *sql.DB, dbCfg dbutil.DBConfig, sourceTable, targetTabl
 }
 
 func updateData(dbConn *sql.DB, table string) error {
-	values, err := dbutil.GetRandomValues(context.Background(), dbConn, "test", table, "e", 3, math.MinInt64, math.MaxInt64, "true", "")
+	values, err := dbutil.GetRandomValues(context.Background(), dbConn, "test", table, "e", 3, math.MinInt64, math.MaxInt64, "true", mysqlDialect{}.RandomSample(3))
 	if err != nil {
 		return err
 	}
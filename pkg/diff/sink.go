@@ -0,0 +1,226 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+)
+
+// FixOp names the kind of change a FixEvent represents.
+type FixOp string
+
+const (
+	FixOpInsert FixOp = "INSERT"
+	FixOpUpdate FixOp = "UPDATE"
+	FixOpDelete FixOp = "DELETE"
+)
+
+// FixEvent is the structured equivalent of a fix-up REPLACE/DELETE
+// statement: instead of a SQL string, it carries the before/after row image
+// so a downstream consumer (e.g. a changefeed sink) can apply it without
+// parsing SQL.
+type FixEvent struct {
+	Op       FixOp
+	Schema   string
+	Table    string
+	Before   map[string]interface{}
+	After    map[string]interface{}
+	CommitTs int64
+
+	// KeyCols names the row's primary/unique key columns, in a fixed
+	// order, so a sink that needs per-key ordering (KafkaSink's
+	// partitionFor) has something stable to hash without depending on Go's
+	// randomized map iteration over Before/After.
+	KeyCols []string
+}
+
+// FixEventSink receives structured fix events alongside (or instead of) the
+// SQL emitted via writeFixSQL, so operators can pipe diff-derived
+// corrections through the same downstream consumers they already run for
+// changefeeds.
+type FixEventSink interface {
+	// Send delivers a single row-change event.
+	Send(ctx context.Context, event FixEvent) error
+	// ResolvedTs marks that every event for ts <= resolvedTs has been sent,
+	// emitted between chunks so a consumer can checkpoint safely.
+	ResolvedTs(ctx context.Context, resolvedTs int64) error
+}
+
+// kafkaProducer is the minimal slice of a Kafka client FixEventSink needs,
+// kept as a narrow local interface so this package doesn't force a specific
+// client library on callers that don't use the Kafka sink.
+type kafkaProducer interface {
+	SendMessage(topic string, partition int32, key, value []byte) error
+}
+
+// KafkaSink serializes FixEvents as TiCDC open-protocol-style JSON messages
+// and publishes them to a Kafka topic, partitioned by primary key so that
+// all changes to one row stay in order.
+type KafkaSink struct {
+	Producer   kafkaProducer
+	Topic      string
+	Partitions int32
+}
+
+// openProtocolKey mirrors the key part of a TiCDC open protocol row-change
+// message: enough to identify what changed and when.
+type openProtocolKey struct {
+	Ts     int64  `json:"ts"`
+	Schema string `json:"scm"`
+	Table  string `json:"tbl"`
+}
+
+// openProtocolValue mirrors the value part: the row image(s) affected. A
+// pure insert/replace carries only `u` (update-to); a delete carries `d`.
+type openProtocolValue struct {
+	Update map[string]interface{} `json:"u,omitempty"`
+	Delete map[string]interface{} `json:"d,omitempty"`
+}
+
+// Send implements FixEventSink.
+func (k *KafkaSink) Send(ctx context.Context, event FixEvent) error {
+	key, err := json.Marshal(openProtocolKey{
+		Ts:     event.CommitTs,
+		Schema: event.Schema,
+		Table:  event.Table,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	value := openProtocolValue{}
+	switch event.Op {
+	case FixOpDelete:
+		value.Delete = event.Before
+	default:
+		value.Update = event.After
+	}
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	partition := k.partitionFor(event)
+	return errors.Trace(k.Producer.SendMessage(k.Topic, partition, key, payload))
+}
+
+// ResolvedTs implements FixEventSink, publishing a key-only message with no
+// value, the open-protocol convention for a resolved-ts watermark, to every
+// partition of the topic.
+func (k *KafkaSink) ResolvedTs(ctx context.Context, resolvedTs int64) error {
+	key, err := json.Marshal(struct {
+		Ts       int64 `json:"ts"`
+		Resolved bool  `json:"resolved"`
+	}{Ts: resolvedTs, Resolved: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for p := int32(0); p < k.partitionCount(); p++ {
+		if err := k.Producer.SendMessage(k.Topic, p, key, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (k *KafkaSink) partitionCount() int32 {
+	if k.Partitions > 0 {
+		return k.Partitions
+	}
+	return 1
+}
+
+// partitionFor hashes the row's primary key to a partition so that every
+// event for a given key lands on the same partition, and therefore is
+// consumed in the order it was sent. It hashes only event.KeyCols, in
+// their fixed order - not the whole row image - since Before/After are
+// maps and ranging over one directly would hash columns in Go's
+// randomized iteration order, sending the same row to a different
+// partition on every call.
+func (k *KafkaSink) partitionFor(event FixEvent) int32 {
+	row := event.After
+	if row == nil {
+		row = event.Before
+	}
+
+	h := fnv.New32a()
+	keyCols := event.KeyCols
+	if len(keyCols) == 0 {
+		// No key columns were supplied (e.g. a hand-built FixEvent in a
+		// test); fall back to every column in a fixed, sorted order so the
+		// partition is at least still deterministic.
+		keyCols = make([]string, 0, len(row))
+		for col := range row {
+			keyCols = append(keyCols, col)
+		}
+		sort.Strings(keyCols)
+	}
+
+	for _, col := range keyCols {
+		_, _ = h.Write([]byte(col))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(toString(row[col])))
+	}
+	return int32(h.Sum32() % uint32(k.partitionCount()))
+}
+
+func toString(v interface{}) string {
+	if v == nil {
+		return "<nil>"
+	}
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// fixEvent builds the FixEvent equivalent of a "replace"/"delete" DML for
+// row, so compareRows can fire both the SQL and the structured event
+// from the same row data. keyCols is recorded on the event so a sink that
+// needs per-key ordering (KafkaSink.partitionFor) doesn't have to rebuild
+// it from the row image.
+func fixEvent(op FixOp, schema, table string, row rowData, keyCols []*model.ColumnInfo) FixEvent {
+	image := make(map[string]interface{}, len(row.data))
+	for col, data := range row.data {
+		if row.null[col] {
+			image[col] = nil
+			continue
+		}
+		image[col] = string(data)
+	}
+
+	names := make([]string, 0, len(keyCols))
+	for _, col := range keyCols {
+		names = append(names, col.Name.O)
+	}
+
+	event := FixEvent{Op: op, Schema: schema, Table: table, KeyCols: names}
+	if op == FixOpDelete {
+		event.Before = image
+	} else {
+		event.After = image
+	}
+	return event
+}
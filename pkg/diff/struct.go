@@ -0,0 +1,249 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+)
+
+// diffTableStruct compares source against target. It returns the ALTER
+// TABLE statements (against target, using its name) that would make target
+// match source, plus whether the two are equal overall. Destructive changes
+// - DROP COLUMN and DROP INDEX - are only emitted when allowDestructive is
+// true; when one is needed but not allowed, it's left out of alters but
+// equal still comes back false, so a caller can't mistake "didn't fix it"
+// for "there was nothing to fix".
+func diffTableStruct(source, target *model.TableInfo, allowDestructive bool) (alters []string, equal bool) {
+	colAlters, colEqual := diffColumns(source, target, allowDestructive)
+	idxAlters, idxEqual := diffIndices(source, target, allowDestructive)
+	charsetAlters := diffCharset(source, target)
+
+	alters = append(alters, colAlters...)
+	alters = append(alters, idxAlters...)
+	alters = append(alters, charsetAlters...)
+
+	equal = colEqual && idxEqual && len(charsetAlters) == 0
+	return alters, equal
+}
+
+func diffColumns(source, target *model.TableInfo, allowDestructive bool) (alters []string, equal bool) {
+	equal = true
+
+	sourceCols := columnsByName(source)
+	targetCols := columnsByName(target)
+
+	for _, col := range source.Columns {
+		other, ok := targetCols[col.Name.L]
+		if !ok {
+			alters = append(alters, fmt.Sprintf(
+				"ALTER TABLE `%s` ADD COLUMN %s;", target.Name.O, columnDefinition(col),
+			))
+			equal = false
+			continue
+		}
+		if alter := diffColumn(target.Name.O, col, other); alter != "" {
+			alters = append(alters, alter)
+			equal = false
+		}
+	}
+
+	for _, col := range target.Columns {
+		if _, ok := sourceCols[col.Name.L]; ok {
+			continue
+		}
+		equal = false
+		if allowDestructive {
+			alters = append(alters, fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN `%s`;", target.Name.O, col.Name.O))
+		}
+	}
+
+	return alters, equal
+}
+
+// diffColumn returns the ALTER TABLE statement needed to bring `target`'s
+// definition of a column in line with `source`'s, or "" if they already
+// match. A difference confined to the default value is expressed as the
+// narrower ALTER COLUMN ... SET/DROP DEFAULT rather than a full MODIFY
+// COLUMN, matching how a human reviewer would write the migration.
+func diffColumn(tableName string, source, target *model.ColumnInfo) string {
+	if columnDefinitionEqual(source, target) {
+		return ""
+	}
+
+	if onlyDefaultDiffers(source, target) {
+		if !hasDefault(source) {
+			return fmt.Sprintf("ALTER TABLE `%s` ALTER COLUMN `%s` DROP DEFAULT;", tableName, target.Name.O)
+		}
+		return fmt.Sprintf("ALTER TABLE `%s` ALTER COLUMN `%s` SET DEFAULT %s;", tableName, target.Name.O, defaultValueSQL(source))
+	}
+
+	return fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN %s;", tableName, columnDefinition(source))
+}
+
+func diffIndices(source, target *model.TableInfo, allowDestructive bool) (alters []string, equal bool) {
+	equal = true
+
+	sourceIdx := indicesByName(source)
+	targetIdx := indicesByName(target)
+
+	for _, idx := range source.Indices {
+		if _, ok := targetIdx[idx.Name.L]; !ok {
+			alters = append(alters, fmt.Sprintf("ALTER TABLE `%s` ADD %s;", target.Name.O, indexDefinition(idx)))
+			equal = false
+		}
+	}
+
+	for _, idx := range target.Indices {
+		if _, ok := sourceIdx[idx.Name.L]; ok {
+			continue
+		}
+		equal = false
+		if allowDestructive {
+			alters = append(alters, fmt.Sprintf("ALTER TABLE `%s` DROP INDEX `%s`;", target.Name.O, idx.Name.O))
+		}
+	}
+
+	return alters, equal
+}
+
+func diffCharset(source, target *model.TableInfo) []string {
+	if source.Charset == target.Charset && source.Collate == target.Collate {
+		return nil
+	}
+	return []string{fmt.Sprintf(
+		"ALTER TABLE `%s` CHARACTER SET %s COLLATE %s;", target.Name.O, source.Charset, source.Collate,
+	)}
+}
+
+func columnsByName(t *model.TableInfo) map[string]*model.ColumnInfo {
+	m := make(map[string]*model.ColumnInfo, len(t.Columns))
+	for _, col := range t.Columns {
+		m[col.Name.L] = col
+	}
+	return m
+}
+
+func indicesByName(t *model.TableInfo) map[string]*model.IndexInfo {
+	m := make(map[string]*model.IndexInfo, len(t.Indices))
+	for _, idx := range t.Indices {
+		m[idx.Name.L] = idx
+	}
+	return m
+}
+
+// columnDefinitionEqual reports whether two columns would produce the same
+// effective schema: same type, nullability, default, and generated
+// expression (virtual vs stored).
+func columnDefinitionEqual(a, b *model.ColumnInfo) bool {
+	if a.FieldType.String() != b.FieldType.String() {
+		return false
+	}
+	if mysql.HasNotNullFlag(a.Flag) != mysql.HasNotNullFlag(b.Flag) {
+		return false
+	}
+	if a.IsGenerated() != b.IsGenerated() {
+		return false
+	}
+	if a.IsGenerated() && (a.GeneratedExprString != b.GeneratedExprString || a.GeneratedStored != b.GeneratedStored) {
+		return false
+	}
+	return !onlyDefaultDiffers(a, b) && defaultsEqual(a, b)
+}
+
+func onlyDefaultDiffers(a, b *model.ColumnInfo) bool {
+	if a.FieldType.String() != b.FieldType.String() {
+		return false
+	}
+	if mysql.HasNotNullFlag(a.Flag) != mysql.HasNotNullFlag(b.Flag) {
+		return false
+	}
+	if a.IsGenerated() || b.IsGenerated() {
+		return false
+	}
+	return !defaultsEqual(a, b)
+}
+
+func defaultsEqual(a, b *model.ColumnInfo) bool {
+	if hasDefault(a) != hasDefault(b) {
+		return false
+	}
+	return fmt.Sprintf("%v", a.DefaultValue) == fmt.Sprintf("%v", b.DefaultValue)
+}
+
+// hasDefault distinguishes "no default clause at all" from an explicit
+// "DEFAULT NULL", which parsers commonly conflate: a column with no default
+// can still report a nil DefaultValue, so we check NoDefaultValueFlag.
+func hasDefault(col *model.ColumnInfo) bool {
+	return !mysql.HasNoDefaultValueFlag(col.Flag)
+}
+
+func defaultValueSQL(col *model.ColumnInfo) string {
+	v := col.DefaultValue
+	if v == nil {
+		return "NULL"
+	}
+	if needsQuoting(col) {
+		return fmt.Sprintf("'%v'", v)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// columnDefinition renders a full column definition, e.g. for ADD COLUMN or
+// MODIFY COLUMN, including its generated-column clause when applicable.
+func columnDefinition(col *model.ColumnInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "`%s` %s", col.Name.O, col.FieldType.String())
+
+	if col.IsGenerated() {
+		kind := "VIRTUAL"
+		if col.GeneratedStored {
+			kind = "STORED"
+		}
+		fmt.Fprintf(&b, " GENERATED ALWAYS AS (%s) %s", col.GeneratedExprString, kind)
+		if mysql.HasNotNullFlag(col.Flag) {
+			b.WriteString(" NOT NULL")
+		}
+		return b.String()
+	}
+
+	if mysql.HasNotNullFlag(col.Flag) {
+		b.WriteString(" NOT NULL")
+	}
+	if hasDefault(col) {
+		fmt.Fprintf(&b, " DEFAULT %s", defaultValueSQL(col))
+	}
+
+	return b.String()
+}
+
+func indexDefinition(idx *model.IndexInfo) string {
+	cols := make([]string, 0, len(idx.Columns))
+	for _, c := range idx.Columns {
+		cols = append(cols, fmt.Sprintf("`%s`", c.Name.O))
+	}
+
+	kind := "INDEX"
+	switch {
+	case idx.Primary:
+		return fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(cols, ","))
+	case idx.Unique:
+		kind = "UNIQUE INDEX"
+	}
+
+	return fmt.Sprintf("%s `%s` (%s)", kind, idx.Name.O, strings.Join(cols, ","))
+}
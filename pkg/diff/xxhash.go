@@ -0,0 +1,89 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diff
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxHash32 constants, per the published algorithm spec.
+const (
+	xxhashPrime1 uint32 = 2654435761
+	xxhashPrime2 uint32 = 2246822519
+	xxhashPrime3 uint32 = 3266489917
+	xxhashPrime4 uint32 = 668265263
+	xxhashPrime5 uint32 = 374761393
+)
+
+// xxhash32 implements xxHash32 (seed 0) in pure Go, used by rowHash when
+// HashXXHash is selected. A chunk's hash used to be computed by an
+// `xxhash64` SQL UDF that wasn't guaranteed to be installed on every
+// server; computing it client-side here means it's always available and,
+// more importantly, gives the same fingerprint for the same row data
+// regardless of which dialect (MySQL or Postgres) produced it.
+func xxhash32(data []byte) uint32 {
+	n := len(data)
+	i := 0
+
+	var h32 uint32
+	if n >= 16 {
+		// The xxhashPrime constants are typed uint32, and an expression made
+		// only of constants is evaluated at compile time, where overflow is
+		// an error instead of a wraparound. The wrapping sum for v1 and the
+		// wrapping negation for v4 therefore go through a variable, so they
+		// are computed at runtime.
+		v1 := xxhashPrime1
+		v1 += xxhashPrime2
+		v2 := xxhashPrime2
+		v3 := uint32(0)
+		v4 := uint32(0)
+		v4 -= xxhashPrime1
+		for ; i+16 <= n; i += 16 {
+			v1 = xxhashRound(v1, binary.LittleEndian.Uint32(data[i:]))
+			v2 = xxhashRound(v2, binary.LittleEndian.Uint32(data[i+4:]))
+			v3 = xxhashRound(v3, binary.LittleEndian.Uint32(data[i+8:]))
+			v4 = xxhashRound(v4, binary.LittleEndian.Uint32(data[i+12:]))
+		}
+		h32 = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h32 = xxhashPrime5
+	}
+
+	h32 += uint32(n)
+
+	for ; i+4 <= n; i += 4 {
+		h32 += binary.LittleEndian.Uint32(data[i:]) * xxhashPrime3
+		h32 = bits.RotateLeft32(h32, 17) * xxhashPrime4
+	}
+	for ; i < n; i++ {
+		h32 += uint32(data[i]) * xxhashPrime5
+		h32 = bits.RotateLeft32(h32, 11) * xxhashPrime1
+	}
+
+	h32 ^= h32 >> 15
+	h32 *= xxhashPrime2
+	h32 ^= h32 >> 13
+	h32 *= xxhashPrime3
+	h32 ^= h32 >> 16
+
+	return h32
+}
+
+func xxhashRound(acc, input uint32) uint32 {
+	acc += input * xxhashPrime2
+	acc = bits.RotateLeft32(acc, 13)
+	acc *= xxhashPrime1
+	return acc
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package importer generates random data for a table so the diff test
+// suite has something to compare against.
+package importer
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb-tools/pkg/dbutil"
+)
+
+// Config describes a random-data generation job.
+type Config struct {
+	TableSQL    string
+	WorkerCount int
+	JobCount    int
+	Batch       int
+	DBCfg       dbutil.DBConfig
+}
+
+// DoProcess creates the configured table and fills it with JobCount rows of
+// randomly generated data, split across WorkerCount workers.
+func DoProcess(cfg *Config) error {
+	db, err := dbutil.OpenDB(cfg.DBCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(cfg.TableSQL); err != nil {
+		return errors.Trace(err)
+	}
+
+	jobCh := make(chan int, cfg.JobCount)
+	for i := 0; i < cfg.JobCount; i++ {
+		jobCh <- i
+	}
+	close(jobCh)
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, cfg.WorkerCount)
+	for w := 0; w < cfg.WorkerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(db, cfg, jobCh); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	if err, ok := <-errCh; ok {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// worker drains jobCh, rendering one row of randomly generated data per job
+// and flushing a REPLACE INTO in Batch-sized groups. Values are generated
+// deterministically from the job id rather than a shared *rand.Rand so that
+// concurrent workers never need to coordinate, and so a date/int primary
+// key column comes out unique across a JobCount-sized run.
+func worker(db *sql.DB, cfg *Config, jobCh <-chan int) error {
+	tableInfo, err := dbutil.GetTableInfoBySQL(cfg.TableSQL)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	batch := cfg.Batch
+	if batch <= 0 {
+		batch = 1
+	}
+	table := fmt.Sprintf("`%s`", tableInfo.Name.O)
+
+	rows := make([]string, 0, batch)
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		query := fmt.Sprintf("REPLACE INTO %s VALUES %s", table, strings.Join(rows, ","))
+		_, err := db.Exec(query)
+		rows = rows[:0]
+		return errors.Trace(err)
+	}
+
+	for id := range jobCh {
+		values := make([]string, 0, len(tableInfo.Columns))
+		for _, col := range tableInfo.Columns {
+			values = append(values, randomValue(col, id))
+		}
+		rows = append(rows, fmt.Sprintf("(%s)", strings.Join(values, ",")))
+		if len(rows) >= batch {
+			if err := flush(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return errors.Trace(flush())
+}
+
+// randomValue renders a SQL literal for one cell of col. id drives every
+// value so a run is reproducible and so columns used as the primary key
+// (which depend only on id) never collide across a JobCount-sized run.
+func randomValue(col *model.ColumnInfo, id int) string {
+	r := rand.New(rand.NewSource(int64(id)))
+
+	switch col.FieldType.Tp {
+	case mysql.TypeDate:
+		d := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, id)
+		return fmt.Sprintf("'%s'", d.Format("2006-01-02"))
+	case mysql.TypeDatetime, mysql.TypeTimestamp:
+		d := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(id) * time.Hour)
+		return fmt.Sprintf("'%s'", d.Format("2006-01-02 15:04:05"))
+	case mysql.TypeDuration:
+		return fmt.Sprintf("'%02d:%02d:%02d'", r.Intn(24), r.Intn(60), r.Intn(60))
+	case mysql.TypeYear:
+		return strconv.Itoa(2000 + id%24)
+	case mysql.TypeVarchar, mysql.TypeString, mysql.TypeVarString:
+		return fmt.Sprintf("'%s'", randomString(r, 8))
+	case mysql.TypeFloat, mysql.TypeDouble, mysql.TypeNewDecimal:
+		return fmt.Sprintf("%d.%02d", id, r.Intn(100))
+	default:
+		return strconv.Itoa(id*1000 + r.Intn(1000))
+	}
+}
+
+func randomString(r *rand.Rand, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+	return string(b)
+}